@@ -12,23 +12,64 @@
 // GNU Affero General Public License for more details.
 //
 // You should have received a copy of the GNU Affero General Public License
-// along with this program.  If not, see <https://www.gnu.org/licenses/>. 
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package main
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dlclark/regexp2"
 
 	"maubot.xyz"
 	"maunium.net/go/gomatrix"
 )
 
+// Config holds the tunables for the plugin that aren't part of a parsed sed
+// script itself.
+type Config struct {
+	// FuzzyThreshold is the maximum Levenshtein score (distance divided by
+	// the longer string's length) a candidate may have to be considered a
+	// fuzzy match. Lower is stricter. A zero value is replaced by the default
+	// (see withDefaults); a negative value disables fuzzy matching entirely.
+	FuzzyThreshold float64
+	// FuzzyLookback caps how many of the most recent events in a room's
+	// EventQueue are scored when no exact match is found.
+	FuzzyLookback int
+	// EditOwnMessages makes the bot send an m.replace edit of the target
+	// event, in place, instead of a reply, when the sed's sender also sent
+	// the message being corrected. Edits of the bot's own messages always
+	// happen regardless of this setting.
+	EditOwnMessages bool
+	// RateLimitBurst is the number of sed commands a single (room, sender)
+	// pair may run back to back before being throttled.
+	RateLimitBurst float64
+	// RateLimitPerSecond is how many tokens a (room, sender) pair regains
+	// per second, up to RateLimitBurst.
+	RateLimitPerSecond float64
+}
+
+// DefaultConfig fills in any field the host's Config leaves zero-valued; see
+// withDefaults and PluginCreator.Create.
+var DefaultConfig = Config{
+	FuzzyThreshold:     0.3,
+	FuzzyLookback:      10,
+	EditOwnMessages:    false,
+	RateLimitBurst:     5,
+	RateLimitPerSecond: 0.5,
+}
+
 type Sed struct {
 	client         maubot.MatrixClient
 	log            maubot.Logger
+	config         Config
+	rateLimiter    *RateLimiter
 	prevEventLock  sync.RWMutex
 	prevEventMap   map[string]map[string]string
 	prevEventQueue map[string]*EventQueue
@@ -56,15 +97,85 @@ const (
 	CommandLongSed  = "net.maunium.sed.long"
 )
 
+// commandLongSedPattern is the CommandLongSed passive-command trigger, with
+// the command itself wrapped in a capturing group so extractScript can slice
+// the script out of the matched location instead of re-searching the body.
+// It relies on a backreference (\2), which Go's stdlib regexp can't compile,
+// so it's compiled with regexp2 like the other backtracking patterns in this
+// file.
+const commandLongSedPattern = `(?i)\bsed\s+((?:(?:/(?:\\.|[^/\\])*/|\d+(?:,\d+)?)d|[sy](.).*\2.*\2))`
+
+var commandLongSedRegex = regexp2.MustCompile(commandLongSedPattern, regexp2.None)
+
+// rateLimitKey identifies the (room, sender) pair a token bucket is tracking.
+type rateLimitKey struct {
+	RoomID string
+	Sender string
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a per-(room, sender) token bucket, so one user spamming sed
+// commands can't exhaust the shared EventQueue or CPU for the whole room.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[rateLimitKey]*tokenBucket
+	burst   float64
+	refill  float64 // tokens regained per second
+}
+
+func NewRateLimiter(burst float64, refillPerSecond float64) *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[rateLimitKey]*tokenBucket),
+		burst:   burst,
+		refill:  refillPerSecond,
+	}
+}
+
+// Allow reports whether the (roomID, sender) pair has a token to spend right
+// now, consuming one if so.
+func (rl *RateLimiter) Allow(roomID, sender string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	key := rateLimitKey{RoomID: roomID, Sender: sender}
+	now := time.Now()
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = bucket
+	} else {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * rl.refill
+		if bucket.tokens > rl.burst {
+			bucket.tokens = rl.burst
+		}
+		bucket.last = now
+	}
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
 func (bot *Sed) Start() {
 	bot.client.SetCommandSpec(&maubot.CommandSpec{
 		PassiveCommands: []maubot.PassiveCommand{{
-			Name:         CommandShortSed,
-			Matches:      `^s([#/])(.*?[^\\]?)[#/](.*?[^\\]?)(?:[#/]([gi]+)?)?$`,
+			Name: CommandShortSed,
+			// A bare "d" is too common an everyday message to treat as a
+			// passive trigger, so standalone delete only fires once it's
+			// qualified by a line or /pattern/ address, as in "2d" or
+			// "/foo/d". Deletes riding along in a multi-command script
+			// (e.g. "s/a/b/; 2d") are still reachable via the [sy] trigger.
+			Matches:      `^(?:(?:/(?:\\.|[^/\\])*/|\d+(?:,\d+)?)d|[sy]([#/]).*[#/].*(?:[#/][gi]*)?)\s*(?:;.*)?$`,
 			MatchAgainst: maubot.MatchAgainstBody,
 		}, {
 			Name:         CommandLongSed,
-			Matches:      `sed s(.)(.*?[^\\]?)\1(.*?[^\\]?)\1([gi]+)?`,
+			Matches:      commandLongSedPattern,
 			MatchAgainst: maubot.MatchAgainstBody,
 		}},
 	})
@@ -73,93 +184,183 @@ func (bot *Sed) Start() {
 
 func (bot *Sed) Stop() {}
 
-type SedStatement struct {
-	Find    *regexp.Regexp
-	Replace string
-	Global  bool
+// Matcher is the subset of *regexp.Regexp that SedStatement needs. It's
+// implemented by the stdlib RE2 engine directly, and by regexp2Matcher for
+// patterns RE2 can't compile (lookaround, backreferences, possessive
+// quantifiers) that real sed users routinely try.
+type Matcher interface {
+	String() string
+	MatchString(s string) bool
+	ReplaceAllString(src, repl string) string
+	ReplaceAllStringFunc(src string, repl func(string) string) string
 }
 
-func (bot *Sed) ParseEvent(evt *maubot.Event) (*SedStatement, error) {
-	sed, err := bot.compilePassiveStatement(evt)
-	if err != nil {
-		return nil, err
-	} else if sed != nil {
-		return sed, nil
-	}
+// regexp2MatchTimeout bounds how long a regexp2 match attempt may run,
+// guarding against catastrophic backtracking in user-supplied patterns.
+const regexp2MatchTimeout = 250 * time.Millisecond
 
-	finder := bot.findFullStatement(evt)
-	if finder != nil {
-		sed, err := bot.compileStatement(evt, finder)
-		if err != nil {
-			return nil, err
-		} else if sed != nil {
-			return sed, nil
-		}
-	}
-	return nil, nil
+// regexp2Matcher adapts *regexp2.Regexp to the Matcher interface.
+type regexp2Matcher struct {
+	re *regexp2.Regexp
 }
 
-func (bot *Sed) findFullStatement(evt *maubot.Event) *regexp.Regexp {
-	index := strings.Index(strings.ToLower(evt.Content.Body), "sed s")
-	if index == -1 || index+len("sed s")+3 > len(evt.Content.Body) {
-		return nil
-	}
+func (m *regexp2Matcher) String() string {
+	return m.re.String()
+}
 
-	separator := evt.Content.Body[index+len("sed s")]
-	regexFinder, _ := regexp.Compile(fmt.Sprintf(`sed s%[1]s(.*?[^\\]?)%[1]s(.*?[^\\]?)%[1]s([gi]+)?`, regexp.QuoteMeta(string(separator))))
-	return regexFinder
+func (m *regexp2Matcher) MatchString(s string) bool {
+	match, _ := m.re.FindStringMatch(s)
+	return match != nil
 }
 
-func (bot *Sed) compilePassiveStatement(evt *maubot.Event) (*SedStatement, error) {
-	if evt.Unsigned.PassiveCommand == nil {
-		return nil, nil
-	}
-	var matchedCommand *gomatrix.MatchedPassiveCommand
-	var ok bool
-	if matchedCommand, ok = evt.Unsigned.PassiveCommand[CommandShortSed]; !ok {
-		if matchedCommand, ok = evt.Unsigned.PassiveCommand[CommandLongSed]; !ok {
-			return nil, nil
-		}
+func (m *regexp2Matcher) ReplaceAllString(src, repl string) string {
+	result, err := m.re.Replace(src, repl, -1, -1)
+	if err != nil {
+		return src
 	}
-	captured := matchedCommand.Captured
-	if len(captured) == 0 || len(captured[0]) != 6 {
-		return nil, nil
+	return result
+}
+
+func (m *regexp2Matcher) ReplaceAllStringFunc(src string, repl func(string) string) string {
+	// regexp2's Capture.Index/Capture.Length are rune offsets, not byte
+	// offsets, so slicing must happen over []rune to stay correct for
+	// multi-byte UTF-8 input.
+	runes := []rune(src)
+	var out strings.Builder
+	lastEnd := 0
+	match, _ := m.re.FindStringMatch(src)
+	for match != nil {
+		out.WriteString(string(runes[lastEnd:match.Index]))
+		out.WriteString(repl(match.String()))
+		lastEnd = match.Index + match.Length
+		match, _ = m.re.FindNextMatch(match)
 	}
-	match := captured[0]
+	out.WriteString(string(runes[lastEnd:]))
+	return out.String()
+}
 
-	regex, err := regexp.Compile(match[3])
+// compileFind compiles pattern with the stdlib RE2 engine, falling back to
+// regexp2 (a PCRE-ish, Oniguruma-like engine) for syntax RE2 rejects.
+func compileFind(pattern string) (Matcher, error) {
+	if re, err := regexp.Compile(pattern); err == nil {
+		return re, nil
+	}
+	re2, err := regexp2.Compile(pattern, regexp2.None)
 	if err != nil {
 		return nil, fmt.Errorf("failed to compile regex: %v", err)
 	}
+	re2.MatchTimeout = regexp2MatchTimeout
+	return &regexp2Matcher{re: re2}, nil
+}
 
-	flags := match[5]
+// maxPatternLength rejects absurdly long find patterns outright.
+const maxPatternLength = 200
 
-	return &SedStatement{
-		Find:    regex,
-		Replace: match[4],
-		Global:  strings.ContainsRune(flags, 'g'),
-	}, nil
+// quantifierGroup tracks whether the content of a currently-open group
+// contains a quantifier anywhere within it, so a quantifier that follows the
+// group's close paren can be recognized as governing an already-repeated
+// subexpression.
+type quantifierGroup struct {
+	hasQuantifier bool
 }
 
-func (bot *Sed) compileStatement(evt *maubot.Event, finder *regexp.Regexp) (*SedStatement, error) {
-	match := finder.FindStringSubmatch(evt.Content.Body)
-	bot.log.Debugln(evt.Content.Body, "---", finder, "---", match)
-	if len(match) != 4 {
-		return nil, nil
+// checkPatternComplexity statically rejects patterns that are too large, or
+// whose find pattern quantifies a subexpression that is itself already
+// quantified (e.g. `(a+)+`, `(a*)*`) — the classic shape of catastrophic
+// backtracking once such a pattern falls through to the backtracking
+// regexp2 engine.
+func checkPatternComplexity(pattern string) error {
+	if len(pattern) > maxPatternLength {
+		return fmt.Errorf("pattern is too long (%d characters, max %d)", len(pattern), maxPatternLength)
 	}
 
-	regex, err := regexp.Compile(match[1])
-	if err != nil {
-		return nil, fmt.Errorf("failed to compile regex: %v", err)
+	var groups []*quantifierGroup
+	var lastClosed *quantifierGroup
+	afterGroupClose := false
+
+	markQuantifier := func() {
+		for _, g := range groups {
+			g.hasQuantifier = true
+		}
 	}
 
-	flags := match[3]
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			afterGroupClose = false
+		case c == '(':
+			groups = append(groups, &quantifierGroup{})
+			afterGroupClose = false
+			// Consume "(?" group-type markers (non-capturing "(?:", lookaround
+			// "(?=", "(?!", "(?<=", "(?<!", named "(?P<name>"/"(?P=name>") so the
+			// '?' that introduces them isn't mistaken for a quantifier applied
+			// to the group we just opened.
+			if i+1 < len(pattern) && pattern[i+1] == '?' {
+				i++
+				if i+1 < len(pattern) {
+					switch pattern[i+1] {
+					case ':', '=', '!':
+						i++
+					case '<':
+						i++
+						if i+1 < len(pattern) && (pattern[i+1] == '=' || pattern[i+1] == '!') {
+							i++
+						}
+					case 'P':
+						i++
+						if i+1 < len(pattern) && (pattern[i+1] == '<' || pattern[i+1] == '=') {
+							i++
+							for i+1 < len(pattern) && pattern[i+1] != '>' {
+								i++
+							}
+							if i+1 < len(pattern) {
+								i++
+							}
+						}
+					}
+				}
+			}
+		case c == ')':
+			if len(groups) > 0 {
+				lastClosed = groups[len(groups)-1]
+				groups = groups[:len(groups)-1]
+				if lastClosed.hasQuantifier && len(groups) > 0 {
+					groups[len(groups)-1].hasQuantifier = true
+				}
+			}
+			afterGroupClose = true
+		case c == '*' || c == '+' || c == '?':
+			if afterGroupClose && lastClosed != nil && lastClosed.hasQuantifier {
+				return fmt.Errorf("pattern repeats an already-repeated subexpression near %q", pattern[:i+1])
+			}
+			markQuantifier()
+			afterGroupClose = false
+		case c == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end == -1 {
+				afterGroupClose = false
+				continue
+			}
+			if afterGroupClose && lastClosed != nil && lastClosed.hasQuantifier {
+				return fmt.Errorf("pattern repeats an already-repeated subexpression near %q", pattern[:i+end+1])
+			}
+			markQuantifier()
+			i += end
+			afterGroupClose = false
+		default:
+			afterGroupClose = false
+		}
+	}
+	return nil
+}
 
-	return &SedStatement{
-		Find:    regex,
-		Replace: match[2],
-		Global:  strings.ContainsRune(flags, 'g'),
-	}, nil
+// SedStatement is a single compiled s/find/replace/flags command.
+type SedStatement struct {
+	Find    Matcher
+	Replace string
+	Global  bool
 }
 
 func (sed *SedStatement) Exec(body string) string {
@@ -177,6 +378,300 @@ func (sed *SedStatement) Exec(body string) string {
 	}
 }
 
+// Address restricts a SedCommand to only apply to lines matching a regex or
+// falling within a 1-indexed line range.
+type Address struct {
+	Regex     *regexp.Regexp
+	LineStart int
+	LineEnd   int
+}
+
+// Matches returns whether the given 1-indexed line matches the address. A
+// nil address always matches.
+func (a *Address) Matches(lineNum int, line string) bool {
+	if a == nil {
+		return true
+	}
+	if a.Regex != nil {
+		return a.Regex.MatchString(line)
+	}
+	if a.LineEnd > 0 {
+		return lineNum >= a.LineStart && lineNum <= a.LineEnd
+	}
+	return lineNum == a.LineStart
+}
+
+// CommandKind is the sed command letter a SedCommand was parsed from.
+type CommandKind int
+
+const (
+	CommandSubstitute CommandKind = iota
+	CommandTransliterate
+	CommandDelete
+)
+
+// SedCommand is one command of a SedProgram, optionally restricted to
+// specific lines by an Address.
+type SedCommand struct {
+	Kind      CommandKind
+	Address   *Address
+	Statement *SedStatement
+	TransFrom string
+	TransTo   string
+}
+
+// SedProgram is an ordered list of sed commands parsed from a single message,
+// e.g. "s/a/b/; s/c/d/g; y/xy/YX/" or "2,4s/a/b/".
+type SedProgram struct {
+	Commands []*SedCommand
+}
+
+// Exec runs every command of the program over body line by line, as real sed
+// does, so addressed commands only affect the lines they target and multi-
+// line bodies such as code blocks or quotes can be edited command by command.
+func (prog *SedProgram) Exec(body string) string {
+	lines := strings.Split(body, "\n")
+	keep := make([]bool, len(lines))
+	for i := range keep {
+		keep[i] = true
+	}
+	for i, line := range lines {
+		lineNum := i + 1
+		for _, cmd := range prog.Commands {
+			if !cmd.Address.Matches(lineNum, line) {
+				continue
+			}
+			switch cmd.Kind {
+			case CommandSubstitute:
+				line = cmd.Statement.Exec(line)
+			case CommandTransliterate:
+				line = transliterate(line, cmd.TransFrom, cmd.TransTo)
+			case CommandDelete:
+				keep[i] = false
+			}
+		}
+		lines[i] = line
+	}
+
+	result := make([]string, 0, len(lines))
+	for i, line := range lines {
+		if keep[i] {
+			result = append(result, line)
+		}
+	}
+	return strings.Join(result, "\n")
+}
+
+// transliterate implements the sed y/from/to/ command: every rune in from is
+// replaced by the rune at the same position in to.
+func transliterate(line, from, to string) string {
+	fromRunes := []rune(from)
+	toRunes := []rune(to)
+	return strings.Map(func(r rune) rune {
+		for i, f := range fromRunes {
+			if f == r && i < len(toRunes) {
+				return toRunes[i]
+			}
+		}
+		return r
+	}, line)
+}
+
+// findUnescapedDelim finds the first occurrence of delim in s that isn't
+// immediately preceded by a backslash escape.
+func findUnescapedDelim(s string, delim byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == delim {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitCommandTrailer splits s at the first unescaped ';' that follows a
+// fully-consumed command (i.e. after its address, delimiters and flags have
+// already been parsed out), returning the text before it (any trailing
+// flags) and what remains to be parsed as further commands.
+func splitCommandTrailer(s string) (trailer, remainder string) {
+	idx := findUnescapedDelim(s, ';')
+	if idx == -1 {
+		return s, ""
+	}
+	return s[:idx], s[idx+1:]
+}
+
+// unescapeChar turns a backslash-escaped ch back into a literal ch, once it
+// no longer needs to be protected from the command/field splitter that
+// required the escape.
+func unescapeChar(s string, ch byte) string {
+	return strings.ReplaceAll(s, "\\"+string(ch), string(ch))
+}
+
+var addressLineRegex = regexp.MustCompile(`^(\d+)(?:,(\d+))?`)
+
+// parseAddress parses an optional leading /regex/ or line[,line] address off
+// of cmd and returns it along with the remainder of the command.
+func parseAddress(cmd string) (*Address, string, error) {
+	cmd = strings.TrimSpace(cmd)
+	if len(cmd) == 0 {
+		return nil, cmd, nil
+	}
+	if cmd[0] == '/' {
+		end := findUnescapedDelim(cmd[1:], '/')
+		if end == -1 {
+			return nil, cmd, fmt.Errorf("unterminated address pattern")
+		}
+		regex, err := regexp.Compile(cmd[1 : 1+end])
+		if err != nil {
+			return nil, cmd, fmt.Errorf("failed to compile address regex: %v", err)
+		}
+		return &Address{Regex: regex}, cmd[1+end+1:], nil
+	}
+	if match := addressLineRegex.FindStringSubmatch(cmd); match != nil {
+		addr := &Address{}
+		fmt.Sscanf(match[1], "%d", &addr.LineStart)
+		if match[2] != "" {
+			fmt.Sscanf(match[2], "%d", &addr.LineEnd)
+		}
+		return addr, cmd[len(match[0]):], nil
+	}
+	return nil, cmd, nil
+}
+
+// parseSedCommand parses a single, optionally addressed sed command (e.g.
+// "2,4s/a/b/g", "/foo/d" or "y/xy/YX/") off the front of raw and returns it
+// along with whatever text is left to parse as further ;-separated commands.
+// Splitting on ';' only happens here, after a command's own delimiters have
+// been fully consumed, so a literal ';' inside a pattern or replacement
+// (e.g. "s/a/x;y/") never needs escaping.
+func parseSedCommand(raw string) (cmd *SedCommand, remainder string, err error) {
+	addr, rest, err := parseAddress(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	rest = strings.TrimSpace(rest)
+	if len(rest) == 0 {
+		return nil, "", nil
+	}
+
+	switch rest[0] {
+	case 'd':
+		_, remainder = splitCommandTrailer(rest[1:])
+		return &SedCommand{Kind: CommandDelete, Address: addr}, remainder, nil
+	case 's', 'y':
+		if len(rest) < 2 {
+			return nil, "", fmt.Errorf("%q command is missing a delimiter", string(rest[0]))
+		}
+		delim := rest[1]
+		body := rest[2:]
+
+		firstEnd := findUnescapedDelim(body, delim)
+		if firstEnd == -1 {
+			return nil, "", fmt.Errorf("unterminated %q command", string(rest[0]))
+		}
+		first := body[:firstEnd]
+		body = body[firstEnd+1:]
+
+		secondEnd := findUnescapedDelim(body, delim)
+		if secondEnd == -1 {
+			return nil, "", fmt.Errorf("unterminated %q command", string(rest[0]))
+		}
+		second := body[:secondEnd]
+		trailer, remainder := splitCommandTrailer(body[secondEnd+1:])
+		flags := strings.TrimSpace(trailer)
+
+		if rest[0] == 'y' {
+			return &SedCommand{
+				Kind:      CommandTransliterate,
+				Address:   addr,
+				TransFrom: unescapeChar(first, ';'),
+				TransTo:   unescapeChar(second, ';'),
+			}, remainder, nil
+		}
+
+		first = unescapeChar(first, ';')
+		if err := checkPatternComplexity(first); err != nil {
+			return nil, "", err
+		}
+		regex, err := compileFind(first)
+		if err != nil {
+			return nil, "", err
+		}
+		return &SedCommand{
+			Kind:    CommandSubstitute,
+			Address: addr,
+			Statement: &SedStatement{
+				Find:    regex,
+				Replace: unescapeChar(second, ';'),
+				Global:  strings.ContainsRune(flags, 'g'),
+			},
+		}, remainder, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported sed command %q", string(rest[0]))
+	}
+}
+
+// parseSedScript parses a full sed script, which may contain several
+// ;-separated, individually addressed commands.
+func parseSedScript(script string) (*SedProgram, error) {
+	var commands []*SedCommand
+	rest := strings.TrimSpace(script)
+	for len(rest) > 0 {
+		cmd, remainder, err := parseSedCommand(rest)
+		if err != nil {
+			return nil, err
+		}
+		if cmd != nil {
+			commands = append(commands, cmd)
+		}
+		rest = strings.TrimSpace(remainder)
+	}
+	if len(commands) == 0 {
+		return nil, nil
+	}
+	return &SedProgram{Commands: commands}, nil
+}
+
+// extractScript pulls the raw sed script text out of the message body that a
+// registered passive command matched against.
+func (bot *Sed) extractScript(evt *maubot.Event) string {
+	if evt.Unsigned.PassiveCommand == nil {
+		return ""
+	}
+	if _, ok := evt.Unsigned.PassiveCommand[CommandShortSed]; ok {
+		return evt.Content.Body
+	}
+	if _, ok := evt.Unsigned.PassiveCommand[CommandLongSed]; ok {
+		// Re-run the same trigger regex the passive command matched against,
+		// rather than an independent "sed " substring search, so the script
+		// is sliced from the word-boundary-validated match location. Group 1
+		// is the command itself; its Index is a rune offset (regexp2), so
+		// slice over []rune to stay correct for multi-byte UTF-8 bodies.
+		if match, _ := commandLongSedRegex.FindStringMatch(evt.Content.Body); match != nil {
+			if g := match.GroupByNumber(1); g != nil && len(g.Captures) > 0 {
+				runes := []rune(evt.Content.Body)
+				start := g.Captures[0].Index
+				if start >= 0 && start <= len(runes) {
+					return string(runes[start:])
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func (bot *Sed) ParseEvent(evt *maubot.Event) (*SedProgram, error) {
+	script := bot.extractScript(evt)
+	if len(script) == 0 {
+		return nil, nil
+	}
+	return parseSedScript(script)
+}
+
 func (bot *Sed) RegisterPrevEvent(evt *maubot.Event) {
 	bot.prevEventLock.Lock()
 	roomMap, ok := bot.prevEventMap[evt.RoomID]
@@ -212,8 +707,98 @@ func (bot *Sed) GetPrevEvent(roomID, userID string) *maubot.Event {
 	return bot.client.GetEvent(roomID, eventID)
 }
 
-func (bot *Sed) TryReplaceEvent(sed *SedStatement, evt, origEvt *maubot.Event) bool {
-	replaced := sed.Exec(origEvt.Content.Body)
+// RelatesTo is the MSC2676 m.relates_to block of an edit event.
+type RelatesTo struct {
+	RelType string `json:"rel_type"`
+	EventID string `json:"event_id"`
+}
+
+// EditMessageContent is the content of an m.room.message event that edits an
+// earlier event in place, per MSC2676.
+type EditMessageContent struct {
+	MsgType    string                 `json:"msgtype"`
+	Body       string                 `json:"body"`
+	NewContent map[string]interface{} `json:"m.new_content"`
+	RelatesTo  *RelatesTo             `json:"m.relates_to"`
+}
+
+// shouldEdit decides whether correcting origEvt should rewrite it in place
+// with an m.replace edit rather than post a reply: always for the bot's own
+// messages, and for anyone else's only when EditOwnMessages is enabled and
+// the sed's sender is also the original author.
+func (bot *Sed) shouldEdit(evt, origEvt *maubot.Event) bool {
+	if origEvt.Sender == bot.client.UserID() {
+		return true
+	}
+	return bot.config.EditOwnMessages && origEvt.Sender == evt.Sender
+}
+
+// TryEditEvent runs sed against origEvt and, if it changed anything, sends an
+// m.replace edit of origEvt instead of replying to it.
+func (bot *Sed) TryEditEvent(sed *SedProgram, evt, origEvt *maubot.Event) bool {
+	replaced, err := bot.execWithTimeout(sed, origEvt.Content.Body)
+	if err != nil {
+		evt.Reply(err.Error())
+		return true
+	}
+	if replaced == origEvt.Content.Body {
+		return false
+	}
+	_, err = bot.client.SendMessageEvent(origEvt.RoomID, gomatrix.EventMessage, &EditMessageContent{
+		MsgType: origEvt.Content.MsgType,
+		Body:    "* " + replaced,
+		NewContent: map[string]interface{}{
+			"msgtype": origEvt.Content.MsgType,
+			"body":    replaced,
+		},
+		RelatesTo: &RelatesTo{
+			RelType: "m.replace",
+			EventID: origEvt.ID,
+		},
+	})
+	if err != nil {
+		bot.log.Errorln("Failed to send edit:", err)
+		return false
+	}
+	return true
+}
+
+// execTimeout bounds how long a single SedProgram.Exec call may run, so a
+// pathological regex (e.g. `(a+)+$` that slips past checkPatternComplexity)
+// can't hang the plugin for everyone sharing the room's EventQueue.
+const execTimeout = 250 * time.Millisecond
+
+// execWithTimeout runs sed.Exec(body) on its own goroutine and stops waiting
+// for it at execTimeout, returning an error instead. The goroutine itself is
+// not stopped and runs on until Exec returns, since neither RE2 nor the
+// regexp2 MatchTimeout can be cancelled mid-ReplaceAllString once execution
+// has started.
+func (bot *Sed) execWithTimeout(sed *SedProgram, body string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	result := make(chan string, 1)
+	go func() {
+		result <- sed.Exec(body)
+	}()
+
+	select {
+	case replaced := <-result:
+		return replaced, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("sed command took too long to run")
+	}
+}
+
+func (bot *Sed) TryReplaceEvent(sed *SedProgram, evt, origEvt *maubot.Event) bool {
+	if bot.shouldEdit(evt, origEvt) {
+		return bot.TryEditEvent(sed, evt, origEvt)
+	}
+	replaced, err := bot.execWithTimeout(sed, origEvt.Content.Body)
+	if err != nil {
+		evt.Reply(err.Error())
+		return true
+	}
 	if replaced == origEvt.Content.Body {
 		return false
 	}
@@ -221,7 +806,146 @@ func (bot *Sed) TryReplaceEvent(sed *SedStatement, evt, origEvt *maubot.Event) b
 	return true
 }
 
-func (bot *Sed) TryReplaceRecentEvent(sed *SedStatement, evt *maubot.Event) bool {
+// literalFindPattern returns the literal (metacharacter-stripped) text of the
+// first substitute command's find pattern, used as the needle for fuzzy
+// target selection.
+func (prog *SedProgram) literalFindPattern() string {
+	for _, cmd := range prog.Commands {
+		if cmd.Kind == CommandSubstitute && cmd.Statement != nil {
+			return stripRegexMeta(cmd.Statement.Find.String())
+		}
+	}
+	return ""
+}
+
+const regexMetaChars = `.*+?^$()[]{}|\`
+
+// stripRegexMeta removes common regex metacharacters from pattern, leaving
+// the literal text a human would have typed as a plain string.
+func stripRegexMeta(pattern string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(regexMetaChars, r) {
+			return -1
+		}
+		return r
+	}, pattern)
+}
+
+// levenshteinDistance computes the edit distance between a and b using the
+// standard two-row dynamic programming algorithm: O(len(a)*len(b)) time,
+// O(min(len(a), len(b))) space.
+func levenshteinDistance(a, b string) int {
+	ar, br := []rune(a), []rune(b)
+	if len(ar) > len(br) {
+		ar, br = br, ar
+	}
+	prev := make([]int, len(ar)+1)
+	cur := make([]int, len(ar)+1)
+	for i := range prev {
+		prev[i] = i
+	}
+	for j := 1; j <= len(br); j++ {
+		cur[0] = j
+		for i := 1; i <= len(ar); i++ {
+			cost := 1
+			if ar[i-1] == br[j-1] {
+				cost = 0
+			}
+			deletion := prev[i] + 1
+			insertion := cur[i-1] + 1
+			substitution := prev[i-1] + cost
+			min := deletion
+			if insertion < min {
+				min = insertion
+			}
+			if substitution < min {
+				min = substitution
+			}
+			cur[i] = min
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(ar)]
+}
+
+// levenshteinScore normalizes a Levenshtein distance to [0,1] by dividing by
+// the length of the longer string, so it can be compared against a threshold
+// independent of message length.
+func levenshteinScore(a, b string) float64 {
+	// levenshteinDistance operates on runes, so the normalizer must too, or
+	// non-ASCII text is scored against an inflated byte-length denominator.
+	maxLen := utf8.RuneCountInString(a)
+	if n := utf8.RuneCountInString(b); n > maxLen {
+		maxLen = n
+	}
+	if maxLen == 0 {
+		return 0
+	}
+	return float64(levenshteinDistance(a, b)) / float64(maxLen)
+}
+
+// TryFuzzyReplaceRecentEvent is used when no event in the room's EventQueue
+// literally matches sed's find pattern. It scores the last FuzzyLookback
+// events by how close their body is to the pattern's literal text and, if
+// the best score clears FuzzyThreshold, runs the substitution against that
+// event anyway.
+func (bot *Sed) TryFuzzyReplaceRecentEvent(sed *SedProgram, evt *maubot.Event) bool {
+	if bot.config.FuzzyThreshold <= 0 {
+		return false
+	}
+	pattern := sed.literalFindPattern()
+	if len(pattern) == 0 {
+		return false
+	}
+
+	bot.prevEventLock.RLock()
+	roomPrevEventQueue, ok := bot.prevEventQueue[evt.RoomID]
+	if !ok {
+		bot.prevEventLock.RUnlock()
+		return false
+	}
+	bot.prevEventLock.RUnlock()
+
+	origPtr := roomPrevEventQueue.Ptr
+	listLen := len(roomPrevEventQueue.List)
+	lookback := bot.config.FuzzyLookback
+	if lookback > listLen {
+		lookback = listLen
+	}
+
+	var best *maubot.Event
+	bestScore := bot.config.FuzzyThreshold
+	for i := 0; i < lookback; i++ {
+		origEvt := roomPrevEventQueue.List[(listLen+origPtr-1-i)%listLen]
+		if origEvt == nil {
+			continue
+		}
+		score := levenshteinScore(pattern, origEvt.Content.Body)
+		if score <= bestScore {
+			bestScore = score
+			best = origEvt
+		}
+	}
+	if best == nil {
+		return false
+	}
+	if bot.shouldEdit(evt, best) {
+		return bot.TryEditEvent(sed, evt, best)
+	}
+
+	replaced, err := bot.execWithTimeout(sed, best.Content.Body)
+	if err != nil {
+		evt.Reply(err.Error())
+		return true
+	}
+	if replaced == best.Content.Body {
+		return false
+	}
+	best.Reply(replaced)
+	return true
+}
+
+func (bot *Sed) TryReplaceRecentEvent(sed *SedProgram, evt *maubot.Event) bool {
 	bot.prevEventLock.RLock()
 	roomPrevEventQueue, ok := bot.prevEventQueue[evt.RoomID]
 	if !ok {
@@ -237,6 +961,9 @@ func (bot *Sed) TryReplaceRecentEvent(sed *SedStatement, evt *maubot.Event) bool
 			return true
 		}
 	}
+	if bot.TryFuzzyReplaceRecentEvent(sed, evt) {
+		return true
+	}
 	return false
 }
 
@@ -246,7 +973,13 @@ func (bot *Sed) MessageHandler(evt *maubot.Event) maubot.EventHandlerResult {
 	sed, err := bot.ParseEvent(evt)
 	if sed == nil {
 		return maubot.Continue
-	} else if err != nil {
+	}
+	// Only a recognized sed command spends a rate limit token — ordinary
+	// chat in the room must never drain a user's bucket.
+	if !bot.rateLimiter.Allow(evt.RoomID, evt.Sender) {
+		return maubot.Continue
+	}
+	if err != nil {
 		evt.Reply(err.Error())
 		return maubot.StopEventPropagation
 	}
@@ -267,11 +1000,32 @@ func (bot *Sed) MessageHandler(evt *maubot.Event) maubot.EventHandlerResult {
 	return maubot.StopEventPropagation
 }
 
+// withDefaults fills any zero-valued field of config with DefaultConfig's
+// value for it, so a host only needs to set the knobs it cares about.
+func withDefaults(config Config) Config {
+	if config.FuzzyThreshold == 0 {
+		config.FuzzyThreshold = DefaultConfig.FuzzyThreshold
+	}
+	if config.FuzzyLookback == 0 {
+		config.FuzzyLookback = DefaultConfig.FuzzyLookback
+	}
+	if config.RateLimitBurst == 0 {
+		config.RateLimitBurst = DefaultConfig.RateLimitBurst
+	}
+	if config.RateLimitPerSecond == 0 {
+		config.RateLimitPerSecond = DefaultConfig.RateLimitPerSecond
+	}
+	return config
+}
+
 var Plugin = maubot.PluginCreator{
-	Create: func(client maubot.MatrixClient, logger maubot.Logger) maubot.Plugin {
+	Create: func(client maubot.MatrixClient, logger maubot.Logger, config Config) maubot.Plugin {
+		config = withDefaults(config)
 		return &Sed{
 			client:         client,
 			log:            logger,
+			config:         config,
+			rateLimiter:    NewRateLimiter(config.RateLimitBurst, config.RateLimitPerSecond),
 			prevEventMap:   make(map[string]map[string]string),
 			prevEventQueue: make(map[string]*EventQueue),
 		}